@@ -0,0 +1,530 @@
+// Package authz provides a pluggable authorization layer for mpp's proxied
+// Prometheus API, so that a single mpp instance can be shared safely across
+// multiple tenants instead of being limited to trusted operators.
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/armon/go-radix"
+	"github.com/hashicorp/go-hclog"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/hcl"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+var log = hclog.Default().Named("authz")
+
+// Verb describes the kind of access a policy grants for a given key prefix.
+type Verb string
+
+const (
+	// Read permits querying series/labels matching the prefix.
+	Read Verb = "read"
+	// Write is reserved for future write-path support.
+	Write Verb = "write"
+	// Deny explicitly forbids access, overriding any broader read/write match.
+	Deny Verb = "deny"
+)
+
+// Policy is consulted by Enforcer to decide whether a given user may perform
+// a given operation.
+type Policy interface {
+	// QueryAllowed reports whether user may query metric.
+	QueryAllowed(user, metric string) bool
+	// SeriesAllowed reports whether user may select series matching matchers.
+	SeriesAllowed(user string, matchers []*labels.Matcher) bool
+	// AdminAllowed reports whether user may access admin-only endpoints,
+	// such as the status page.
+	AdminAllowed(user string) bool
+	// TenantMatcher returns the mandatory label matcher that should be
+	// injected into user's queries to scope them to their tenant, or nil if
+	// none is configured.
+	TenantMatcher(user string) *labels.Matcher
+}
+
+// rule is a single entry in a user's policy document.
+type rule struct {
+	Prefix string `json:"prefix" hcl:"prefix"`
+	Verb   Verb   `json:"verb" hcl:"verb"`
+}
+
+// userPolicy is the parsed policy document for a single user. Tenant lives
+// here rather than on rule: a user's tenant scoping is a single, document-
+// wide fact, not something that should vary per readable-prefix rule (and
+// the normal multi-rule-per-user pattern made "which rule's Tenant wins"
+// ambiguous when it lived there).
+type userPolicy struct {
+	Admin  bool   `json:"admin" hcl:"admin"`
+	Tenant string `json:"tenant" hcl:"tenant"`
+	Rules  []rule `json:"rules" hcl:"rule"`
+}
+
+// PolicyStore loads policy documents (HCL or JSON) and indexes their rules by
+// metric-name/label-value prefix in a radix tree, so lookups during request
+// handling are cheap regardless of how many rules are configured.
+type PolicyStore struct {
+	paths []string
+
+	mu       sync.RWMutex
+	policies map[string]*userPolicy // user -> policy
+	trees    map[string]*radix.Tree // user -> prefix -> rule
+}
+
+// NewPolicyStore loads policy documents from paths and begins watching SIGHUP
+// to reload. Each path must be a single user's policy file, named after the
+// user (e.g. "alice.json" or "alice.hcl"); directories are not expanded, and
+// a path that names one fails the load. The store defaults to deny for any
+// user/prefix with no matching rule.
+func NewPolicyStore(paths ...string) (*PolicyStore, error) {
+	s := &PolicyStore{paths: paths}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	s.watchReload()
+	return s, nil
+}
+
+func (s *PolicyStore) watchReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Info("reloading authz policies on SIGHUP")
+			if err := s.reload(); err != nil {
+				log.Error("failed to reload authz policies", "error", err)
+			}
+		}
+	}()
+}
+
+func (s *PolicyStore) reload() error {
+	policies := map[string]*userPolicy{}
+	for _, p := range s.paths {
+		user, pol, err := loadPolicyFile(p)
+		if err != nil {
+			return fmt.Errorf("loading policy %s: %v", p, err)
+		}
+		policies[user] = pol
+	}
+
+	trees := map[string]*radix.Tree{}
+	for user, pol := range policies {
+		tree := radix.New()
+		for _, r := range pol.Rules {
+			tree.Insert(r.Prefix, r)
+		}
+		trees[user] = tree
+	}
+
+	s.mu.Lock()
+	s.policies = policies
+	s.trees = trees
+	s.mu.Unlock()
+	return nil
+}
+
+func loadPolicyFile(path string) (user string, pol *userPolicy, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	user = strings.TrimSuffix(strings.TrimSuffix(path, ".json"), ".hcl")
+	if i := strings.LastIndex(user, "/"); i >= 0 {
+		user = user[i+1:]
+	}
+
+	pol = &userPolicy{}
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, pol)
+	} else {
+		err = hcl.Unmarshal(data, pol)
+	}
+	return user, pol, err
+}
+
+func (s *PolicyStore) ruleFor(user, key string) (rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tree, ok := s.trees[user]
+	if !ok {
+		return rule{}, false
+	}
+	_, v, ok := tree.LongestPrefix(key)
+	if !ok {
+		return rule{}, false
+	}
+	return v.(rule), true
+}
+
+// QueryAllowed implements Policy.
+func (s *PolicyStore) QueryAllowed(user, metric string) bool {
+	r, ok := s.ruleFor(user, metric)
+	return ok && r.Verb == Read
+}
+
+// SeriesAllowed implements Policy. It is default-deny: a selector with no
+// metric-name matcher at all (e.g. `match[]={instance=~".+"}`) would
+// otherwise let a caller enumerate series across every tenant by simply
+// avoiding `__name__`, so at least one recognized, allowed metric matcher is
+// required. A negative `__name__` matcher (`!=`/`!~`) is rejected outright:
+// it selects every metric *except* the given value, so it can never be
+// checked against a specific policy rule the way a positive match can.
+func (s *PolicyStore) SeriesAllowed(user string, matchers []*labels.Matcher) bool {
+	sawMetricMatcher := false
+	for _, m := range matchers {
+		if m.Name != labels.MetricName {
+			continue
+		}
+		switch m.Type {
+		case labels.MatchEqual, labels.MatchRegexp:
+			sawMetricMatcher = true
+			if !s.QueryAllowed(user, m.Value) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return sawMetricMatcher
+}
+
+// AdminAllowed implements Policy.
+func (s *PolicyStore) AdminAllowed(user string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pol, ok := s.policies[user]
+	return ok && pol.Admin
+}
+
+// TenantMatcher implements Policy.
+func (s *PolicyStore) TenantMatcher(user string) *labels.Matcher {
+	s.mu.RLock()
+	pol, ok := s.policies[user]
+	s.mu.RUnlock()
+	if !ok || pol.Tenant == "" {
+		return nil
+	}
+	m, err := labels.NewMatcher(labels.MatchEqual, "tenant_id", pol.Tenant)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// RequestIDHeader is the header Enforcer uses to correlate its allow/deny
+// log lines with Router's own per-request logging. Enforcer runs ahead of
+// Router in the proxy's middleware chain, so it is the one that mints the
+// ID when none is already present (e.g. from an upstream load balancer);
+// Router reuses whatever value it finds here rather than generating its own.
+const RequestIDHeader = "X-Request-Id"
+
+// Authenticator resolves the caller's identity from an inbound request, e.g.
+// from a bearer token or mTLS client certificate CN.
+type Authenticator func(req *http.Request) (user string, ok bool)
+
+// NewBearerTokenAuthenticator returns an Authenticator that looks up the
+// bearer token in the request's Authorization header against tokens, a map
+// of token to user name. It denies requests with no or unrecognized tokens.
+func NewBearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	return func(req *http.Request) (string, bool) {
+		auth := req.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			return "", false
+		}
+		user, ok := tokens[strings.TrimPrefix(auth, prefix)]
+		return user, ok
+	}
+}
+
+// NewMTLSAuthenticator returns an Authenticator that identifies the caller
+// by the common name of their TLS client certificate. It is intended for use
+// behind a listener configured with tls.RequireAndVerifyClientCert; requests
+// with no peer certificate (including all plaintext requests) are denied.
+func NewMTLSAuthenticator() Authenticator {
+	return func(req *http.Request) (string, bool) {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return "", false
+		}
+		return req.TLS.PeerCertificates[0].Subject.CommonName, true
+	}
+}
+
+// Enforcer is an http.Handler middleware that authenticates the caller,
+// parses proxied PromQL to determine the metrics/series being accessed, and
+// consults a Policy before allowing the request through to next.
+type Enforcer struct {
+	next    http.Handler
+	policy  Policy
+	authn   Authenticator
+	allowed counter
+	denied  counter
+}
+
+// counter is the minimal single-method interface Enforcer needs for
+// monotonic counters; it lets Enforcer stay decoupled from the concrete
+// prometheus client types used by Router.metrics.
+type counter interface {
+	Inc()
+}
+
+// NewEnforcer builds an Enforcer that authenticates requests with authn and
+// authorizes them against policy. allowed/denied, if non-nil, are
+// incremented per request; callers that want these counts to show up
+// alongside mpp's other metrics should use Router.NewEnforcer instead of
+// calling this directly, so they're wired to Router.metrics.
+func NewEnforcer(next http.Handler, policy Policy, authn Authenticator, allowed, denied counter) *Enforcer {
+	return &Enforcer{next: next, policy: policy, authn: authn, allowed: allowed, denied: denied}
+}
+
+func (e *Enforcer) deny(w http.ResponseWriter, req *http.Request, user, reason string) {
+	if e.denied != nil {
+		e.denied.Inc()
+	}
+	log.Info("denied request", "request_id", req.Header.Get(RequestIDHeader), "user", user, "path", req.URL.Path, "reason", reason)
+	http.Error(w, reason, http.StatusForbidden)
+}
+
+func (e *Enforcer) allow(req *http.Request, user string) {
+	if e.allowed != nil {
+		e.allowed.Inc()
+	}
+	log.Debug("allowed request", "request_id", req.Header.Get(RequestIDHeader), "user", user, "path", req.URL.Path)
+}
+
+func (e *Enforcer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Enforcer sits ahead of Router in the chain, so it is responsible for
+	// minting the correlation ID both sides log under, unless one already
+	// arrived on the request (e.g. from an upstream load balancer).
+	if req.Header.Get(RequestIDHeader) == "" {
+		requestID, err := uuid.GenerateUUID()
+		if err != nil {
+			requestID = "unknown"
+		}
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+
+	user, ok := e.authn(req)
+	if !ok {
+		e.deny(w, req, "", "unauthenticated")
+		return
+	}
+
+	// Real Prometheus API clients (Grafana, curl -d) commonly POST
+	// query/match[] as a form body instead of URL query params, to avoid URL
+	// length limits. parseParams reads both and restores req.Body afterward
+	// so the proxied request still reaches the backend intact.
+	params, err := parseParams(req)
+	if err != nil {
+		e.deny(w, req, user, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	switch req.URL.Path {
+	case "/status":
+		if !e.policy.AdminAllowed(user) {
+			e.deny(w, req, user, "admin access denied")
+			return
+		}
+	case "/api/v1/query", "/api/v1/query_range":
+		expr, err := promql.ParseExpr(params.Get("query"))
+		if err != nil {
+			e.deny(w, req, user, fmt.Sprintf("invalid query: %v", err))
+			return
+		}
+		metrics := metricsIn(expr)
+		for _, m := range metrics {
+			if !e.policy.QueryAllowed(user, m) {
+				e.deny(w, req, user, fmt.Sprintf("access to metric %q denied", m))
+				return
+			}
+		}
+		if tenant := e.policy.TenantMatcher(user); tenant != nil {
+			injectTenantMatcher(expr, tenant)
+			if err := setParam(req, params, "query", expr.String()); err != nil {
+				e.deny(w, req, user, fmt.Sprintf("failed to scope query to tenant: %v", err))
+				return
+			}
+		}
+	case "/api/v1/series":
+		selector := params.Get("match[]")
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			e.deny(w, req, user, fmt.Sprintf("invalid series selector: %v", err))
+			return
+		}
+		if !e.policy.SeriesAllowed(user, matchers) {
+			e.deny(w, req, user, "access to one or more requested series denied")
+			return
+		}
+		if tenant := e.policy.TenantMatcher(user); tenant != nil {
+			matchers = append(matchers, tenant)
+			if err := setParam(req, params, "match[]", matchersString(matchers)); err != nil {
+				e.deny(w, req, user, fmt.Sprintf("failed to scope series selector to tenant: %v", err))
+				return
+			}
+		}
+	case "/api/v1/labels":
+		// label names are not metric-scoped; only gate on the caller having
+		// at least one allowed (non-deny) metric rule, handled the same as
+		// admin for now.
+		if !e.policy.AdminAllowed(user) && len(e.readablePoliciesFor(user)) == 0 {
+			e.deny(w, req, user, "access denied")
+			return
+		}
+	}
+
+	e.allow(req, user)
+	e.next.ServeHTTP(w, req)
+}
+
+// readablePoliciesFor returns the prefixes user has Read access to. Deny
+// rules don't count: a user configured with only deny exceptions (a normal
+// pattern under default-deny) has no readable prefixes and should not pass
+// an "any rule exists" check.
+func (e *Enforcer) readablePoliciesFor(user string) []string {
+	store, ok := e.policy.(*PolicyStore)
+	if !ok {
+		return nil
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	pol, ok := store.policies[user]
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, r := range pol.Rules {
+		if r.Verb == Read {
+			names = append(names, r.Prefix)
+		}
+	}
+	return names
+}
+
+// metricsIn walks expr and returns the distinct metric names it references.
+// It must inspect both VectorSelector and MatrixSelector nodes: a
+// range-vector-only query such as `rate(secret_total[5m])` parses to a bare
+// MatrixSelector with no enclosing VectorSelector, so missing that case
+// would let such queries skip the QueryAllowed check entirely.
+func metricsIn(expr promql.Expr) []string {
+	var metrics []string
+	seen := map[string]bool{}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			metrics = append(metrics, name)
+		}
+	}
+	// addSelector covers both selector syntaxes PromQL accepts: the bare
+	// "metric_name{...}" form, where the parser already populates Name, and
+	// the brace-only "{__name__=\"metric_name\"}" form, where Name is empty
+	// and the constraint lives only in LabelMatchers.
+	addSelector := func(name string, matchers []*labels.Matcher) {
+		if name != "" {
+			add(name)
+			return
+		}
+		for _, m := range matchers {
+			if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+				add(m.Value)
+			}
+		}
+	}
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch sel := node.(type) {
+		case *promql.VectorSelector:
+			addSelector(sel.Name, sel.LabelMatchers)
+		case *promql.MatrixSelector:
+			addSelector(sel.Name, sel.LabelMatchers)
+		}
+		return nil
+	})
+	return metrics
+}
+
+// injectTenantMatcher mutates every vector/matrix selector in expr to add
+// tenant as a mandatory label matcher. This enforces tenant scoping even if
+// the caller's query tried to select series outside their tenant. Callers
+// write the re-serialized expr back to the request themselves via setParam.
+func injectTenantMatcher(expr promql.Expr, tenant *labels.Matcher) {
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch sel := node.(type) {
+		case *promql.VectorSelector:
+			sel.LabelMatchers = append(sel.LabelMatchers, tenant)
+		case *promql.MatrixSelector:
+			sel.LabelMatchers = append(sel.LabelMatchers, tenant)
+		}
+		return nil
+	})
+}
+
+// matchersString renders matchers back into a PromQL series selector, e.g.
+// `{__name__="up",tenant_id="acme"}`.
+func matchersString(matchers []*labels.Matcher) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// parseParams returns the combined URL-query and form-body parameters of
+// req, restoring req.Body afterward so the request can still be proxied
+// through to the backend with its original body intact. Real Prometheus API
+// clients commonly POST query/match[] as a form body instead of (or as well
+// as) URL query params.
+func parseParams(req *http.Request) (url.Values, error) {
+	params := url.Values{}
+	for k, vs := range req.URL.Query() {
+		params[k] = append(params[k], vs...)
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Body == nil {
+		return params, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range form {
+		params[k] = append(params[k], vs...)
+	}
+	return params, nil
+}
+
+// setParam rewrites key to value in req: in the URL query for GET/HEAD
+// requests, or otherwise in the form body, which is then replaced by all of
+// params (including any that arrived in the URL query; the URL query itself
+// is left as it was).
+func setParam(req *http.Request, params url.Values, key, value string) error {
+	params.Set(key, value)
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		req.URL.RawQuery = params.Encode()
+		return nil
+	}
+	encoded := params.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(encoded))
+	req.ContentLength = int64(len(encoded))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+	return nil
+}
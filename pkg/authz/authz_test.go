@@ -0,0 +1,145 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/armon/go-radix"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// newTestStore builds a PolicyStore for a single user directly, bypassing
+// file loading, mirroring the indexing reload() performs.
+func newTestStore(user string, pol *userPolicy) *PolicyStore {
+	tree := radix.New()
+	for _, r := range pol.Rules {
+		tree.Insert(r.Prefix, r)
+	}
+	return &PolicyStore{
+		policies: map[string]*userPolicy{user: pol},
+		trees:    map[string]*radix.Tree{user: tree},
+	}
+}
+
+func mustMatcher(t *testing.T, mtype labels.MatchType, name, value string) *labels.Matcher {
+	t.Helper()
+	m, err := labels.NewMatcher(mtype, name, value)
+	if err != nil {
+		t.Fatalf("building matcher: %v", err)
+	}
+	return m
+}
+
+func TestSeriesAllowed(t *testing.T) {
+	store := newTestStore("alice", &userPolicy{
+		Rules: []rule{
+			{Prefix: "http_", Verb: Read},
+			{Prefix: "secret_", Verb: Deny},
+		},
+	})
+
+	cases := []struct {
+		name     string
+		matchers []*labels.Matcher
+		want     bool
+	}{
+		{
+			name:     "allowed metric name matcher",
+			matchers: []*labels.Matcher{mustMatcher(t, labels.MatchEqual, labels.MetricName, "http_requests_total")},
+			want:     true,
+		},
+		{
+			name:     "denied metric name matcher",
+			matchers: []*labels.Matcher{mustMatcher(t, labels.MatchEqual, labels.MetricName, "secret_total")},
+			want:     false,
+		},
+		{
+			name:     "no metric name matcher at all must not fail open",
+			matchers: []*labels.Matcher{mustMatcher(t, labels.MatchRegexp, "instance", ".+")},
+			want:     false,
+		},
+		{
+			name:     "no matchers at all must not fail open",
+			matchers: nil,
+			want:     false,
+		},
+		{
+			name:     "negative metric name matcher must not fail open",
+			matchers: []*labels.Matcher{mustMatcher(t, labels.MatchNotEqual, labels.MetricName, "secret_total")},
+			want:     false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := store.SeriesAllowed("alice", c.matchers); got != c.want {
+				t.Errorf("SeriesAllowed() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTenantMatcher(t *testing.T) {
+	store := newTestStore("alice", &userPolicy{
+		Tenant: "team-a",
+		Rules: []rule{
+			{Prefix: "http_", Verb: Read},
+			{Prefix: "secret_", Verb: Deny},
+		},
+	})
+
+	m := store.TenantMatcher("alice")
+	if m == nil {
+		t.Fatal("TenantMatcher() = nil, want a matcher scoping to team-a")
+	}
+	if m.Name != "tenant_id" || m.Value != "team-a" {
+		t.Errorf("TenantMatcher() = %s%s%q, want tenant_id=\"team-a\"", m.Name, m.Type, m.Value)
+	}
+}
+
+func TestMetricsIn(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "vector selector",
+			query: `http_requests_total{code="500"}`,
+			want:  []string{"http_requests_total"},
+		},
+		{
+			name:  "range-vector-only query has no enclosing vector selector",
+			query: `rate(secret_total[5m])`,
+			want:  []string{"secret_total"},
+		},
+		{
+			name:  "binary expression collects both sides, deduped",
+			query: `http_requests_total / sum(http_requests_total)`,
+			want:  []string{"http_requests_total"},
+		},
+		{
+			name:  "brace-only selector has no bare identifier, only a __name__ label matcher",
+			query: `{__name__="secret_total",code="500"}`,
+			want:  []string{"secret_total"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, err := promql.ParseExpr(c.query)
+			if err != nil {
+				t.Fatalf("parsing query: %v", err)
+			}
+			got := metricsIn(expr)
+			if len(got) != len(c.want) {
+				t.Fatalf("metricsIn() = %v, want %v", got, c.want)
+			}
+			for i, name := range c.want {
+				if got[i] != name {
+					t.Errorf("metricsIn()[%d] = %q, want %q", i, got[i], name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Package locator discovers candidate Prometheus backend endpoints from a
+// configurable source (Kubernetes, Marathon, static config, DNS-SRV, ...).
+package locator
+
+import "net/url"
+
+// PrometheusEndpoint describes a single discovered Prometheus backend.
+type PrometheusEndpoint struct {
+	URL    *url.URL
+	Labels map[string]string
+}
+
+// Locator discovers the current set of candidate Prometheus endpoints.
+type Locator interface {
+	Locate() ([]*PrometheusEndpoint, error)
+}
+
+// EventType describes what changed about an endpoint in an Event.
+type EventType string
+
+const (
+	// Added indicates a new endpoint became available.
+	Added EventType = "added"
+	// Removed indicates a previously available endpoint is gone.
+	Removed EventType = "removed"
+	// HealthChanged indicates an existing endpoint's health status changed.
+	HealthChanged EventType = "health_changed"
+)
+
+// Event is pushed by a Watcher whenever the set of endpoints it watches
+// changes.
+type Event struct {
+	Type     EventType
+	Source   string
+	Endpoint *PrometheusEndpoint
+}
@@ -0,0 +1,13 @@
+package locator
+
+import "context"
+
+// Watcher is implemented by locators that can push endpoint changes as they
+// happen (e.g. Kubernetes, Marathon), rather than only being polled. Router
+// fans these events in alongside its periodic selection ticker so it can
+// react to churn immediately instead of waiting for the next tick.
+type Watcher interface {
+	// Watch returns a channel of Events for as long as ctx is not done, and
+	// closes it once ctx is cancelled or the underlying watch ends.
+	Watch(ctx context.Context) <-chan Event
+}
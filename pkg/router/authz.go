@@ -0,0 +1,31 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/matt-deboer/mpp/pkg/authz"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pathCounter adapts one labeled side (the "path" label) of a
+// *prometheus.CounterVec into the single-method counter interface
+// authz.Enforcer expects, without making authz depend on the prometheus
+// client or on Router's metrics type.
+type pathCounter struct {
+	vec  *prometheus.CounterVec
+	path string
+}
+
+func (c pathCounter) Inc() {
+	c.vec.WithLabelValues(c.path).Inc()
+}
+
+// NewEnforcer wraps next with an authz.Enforcer, wiring its allow/deny
+// counts into r.metrics so they show up alongside mpp's other metrics. path
+// is the HTTP path the returned handler will be registered under, and is
+// used only to label the allowed/denied counters.
+func (r *Router) NewEnforcer(next http.Handler, policy authz.Policy, authn authz.Authenticator, path string) *authz.Enforcer {
+	return authz.NewEnforcer(next, policy, authn,
+		pathCounter{vec: r.metrics.authzAllowed, path: path},
+		pathCounter{vec: r.metrics.authzDenied, path: path})
+}
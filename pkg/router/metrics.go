@@ -0,0 +1,39 @@
+package router
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics holds the prometheus instrumentation Router exposes about its own
+// operation, as opposed to the metrics it proxies through to backends.
+type metrics struct {
+	selectedBackends prometheus.Gauge
+	selectionEvents  prometheus.Counter
+	authzAllowed     *prometheus.CounterVec
+	authzDenied      *prometheus.CounterVec
+}
+
+func newMetrics(namespace string) *metrics {
+	m := &metrics{
+		selectedBackends: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "selected_backends",
+			Help:      "The number of backends currently selected for proxying.",
+		}),
+		selectionEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "selection_events_total",
+			Help:      "The total number of backend selection runs performed.",
+		}),
+		authzAllowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "authz_allowed_total",
+			Help:      "The total number of requests allowed by the authz policy, by path.",
+		}, []string{"path"}),
+		authzDenied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "authz_denied_total",
+			Help:      "The total number of requests denied by the authz policy, by path.",
+		}, []string{"path"}),
+	}
+	prometheus.MustRegister(m.selectedBackends, m.selectionEvents, m.authzAllowed, m.authzDenied)
+	return m
+}
@@ -1,6 +1,7 @@
 package router
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -9,10 +10,13 @@ import (
 
 	"sync"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-hclog"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/matt-deboer/mpp/pkg/authz"
 	"github.com/matt-deboer/mpp/pkg/locator"
 	"github.com/matt-deboer/mpp/pkg/selector"
 	"github.com/matt-deboer/mpp/pkg/version"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/vulcand/oxy/buffer"
 	"github.com/vulcand/oxy/forward"
 )
@@ -23,14 +27,29 @@ type Router struct {
 	selector        *selector.Selector
 	selection       *selector.Result
 	forward         http.Handler
+	transport       *http.Transport
 	buffer          *buffer.Buffer
 	rewriter        urlRewriter
 	affinityOptions []AffinityOption
 	interval        time.Duration
 	metrics         *metrics
+	tracer          Tracer
+	// Logger receives Router's structured, leveled log output. Defaults to a
+	// no-op logger so Router can always log unconditionally. The tracing
+	// helpers and authz log through their own named hclog.Default() loggers,
+	// not through this field.
+	Logger hclog.Logger
 	// used to mark control of the selection process
 	theConch            chan struct{}
 	selectionInProgress sync.RWMutex
+	// cancel stops the selection loop started by NewRouter
+	cancel context.CancelFunc
+	// stopped is closed once the selection loop has returned
+	stopped chan struct{}
+	// lastSelectionReason records why the most recent selection ran, e.g.
+	// "timer" or "event: <locator>", for surfacing on the status page.
+	lastSelectionReason string
+	lastSelectionMu     sync.RWMutex
 }
 
 // Status contains a snapshot status summary of the router state
@@ -41,43 +60,100 @@ type Status struct {
 	AffinityOptions     string
 	ComparisonMetric    string
 	Interval            time.Duration
+	LastSelectionReason string
 }
 
+// selectionDebounce is how long Router waits after the most recent locator
+// event in a burst before re-running selection; each new event restarts the
+// wait, so a flurry of add/remove events (e.g. a rolling deploy) collapses
+// into one doSelection call.
+const selectionDebounce = 250 * time.Millisecond
+
 type urlRewriter func(u *url.URL)
 
-// NewRouter constructs a new router based on the provided stategy and locators
-func NewRouter(interval time.Duration, affinityOptions []AffinityOption,
-	locators []locator.Locator, strategyArgs ...string) (*Router, error) {
+// NewRouter constructs a new router based on the provided stategy and locators.
+// The selection loop runs for the lifetime of ctx; cancelling ctx (or calling
+// Shutdown) stops it. A nil tracer disables tracing; a nil logger disables
+// Router's own logging (the tracing helpers' logger is not affected).
+func NewRouter(ctx context.Context, interval time.Duration, affinityOptions []AffinityOption,
+	locators []locator.Locator, tracer Tracer, logger hclog.Logger, strategyArgs ...string) (*Router, error) {
 
 	sel, err := selector.NewSelector(locators, strategyArgs...)
 	if err != nil {
 		return nil, err
 	}
 
+	if tracer == nil {
+		tracer = noopTracer()
+	}
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	r := &Router{
 		locators:        locators,
 		selector:        sel,
 		affinityOptions: affinityOptions,
 		interval:        interval,
 		metrics:         newMetrics(version.Name),
+		tracer:          tracer,
+		Logger:          logger,
 		theConch:        make(chan struct{}, 1),
+		cancel:          cancel,
+		stopped:         make(chan struct{}),
 	}
 
 	// Set up the lock
 	r.theConch <- struct{}{}
-	r.doSelection()
+	r.doSelection(ctx, "initial")
+
+	events := r.watchLocators(ctx)
 	go func() {
-		// TODO: create shutdown channel for this
+		defer close(r.stopped)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		var debounce *time.Timer
+		var debounceC <-chan time.Time
+		pendingReason := ""
 		for {
-			if log.GetLevel() >= log.DebugLevel {
-				log.Debugf("Backend selection is sleeping for %s", interval)
+			select {
+			case <-ctx.Done():
+				r.Logger.Debug("selection loop stopping", "error", ctx.Err())
+				if debounce != nil {
+					debounce.Stop()
+				}
+				return
+			case <-ticker.C:
+				r.doSelection(ctx, "timer")
+			case ev, ok := <-events:
+				if !ok {
+					// No locator implements Watcher (or all of them have
+					// stopped); nil the channel so this case blocks forever
+					// instead of firing on every loop iteration.
+					events = nil
+					continue
+				}
+				pendingReason = fmt.Sprintf("event: %s", ev.Source)
+				if debounce == nil {
+					debounce = time.NewTimer(selectionDebounce)
+					debounceC = debounce.C
+				} else {
+					if !debounce.Stop() {
+						<-debounce.C
+					}
+					debounce.Reset(selectionDebounce)
+				}
+			case <-debounceC:
+				r.doSelection(ctx, pendingReason)
+				debounce = nil
+				debounceC = nil
 			}
-			time.Sleep(r.interval)
-			r.doSelection()
 		}
 	}()
 
-	r.forward, _ = forward.New()
+	r.transport = &http.Transport{}
+	r.forward, _ = forward.New(forward.RoundTripper(r.transport))
 	r.buffer, _ = buffer.New(&internalRouter{
 		router:   r,
 		affinity: newAffinityProvider(affinityOptions),
@@ -86,37 +162,169 @@ func NewRouter(interval time.Duration, affinityOptions []AffinityOption,
 	return r, nil
 }
 
+// watchLocators fans in events from every configured locator that implements
+// locator.Watcher into a single channel. The channel is closed once every
+// watcher has stopped (ctx is done or its own channel closed), which is
+// straight away when no locator implements locator.Watcher. The
+// periodic ticker in NewRouter remains as a floor for locators that only
+// support polling.
+func (r *Router) watchLocators(ctx context.Context) <-chan locator.Event {
+	out := make(chan locator.Event)
+	var wg sync.WaitGroup
+	for _, loc := range r.locators {
+		watcher, ok := loc.(locator.Watcher)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(w locator.Watcher) {
+			defer wg.Done()
+			events := w.Watch(ctx)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev, ok := <-events:
+					if !ok {
+						return
+					}
+					select {
+					case out <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(watcher)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// Shutdown stops the selection loop and waits for any in-flight selection to
+// finish, bounded by ctx. It then releases the idle connections held by the
+// forward handler's transport. Neither oxy's forward.Forwarder nor its
+// buffer.Buffer implement io.Closer, so there is nothing else to flush here;
+// the transport is the only resource we own that needs releasing.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.cancel()
+
+	select {
+	case <-r.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Wait for any selection already in progress (i.e. holding theConch) to
+	// release it, then take it ourselves so no further selection can start.
+	select {
+	case <-r.theConch:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// authz.Enforcer, when present, runs ahead of Router in the chain and
+	// mints this ID so the two sides' logs can be joined on one key; fall
+	// back to generating our own when Router is used standalone.
+	requestID := req.Header.Get(authz.RequestIDHeader)
+	if requestID == "" {
+		var err error
+		requestID, err = uuid.GenerateUUID()
+		if err != nil {
+			requestID = "unknown"
+		}
+		req.Header.Set(authz.RequestIDHeader, requestID)
+	}
+	logger := r.Logger.With("request_id", requestID)
+
+	parentCtx := r.tracer.Extract(req)
+	span := r.tracer.StartSpan("mpp.proxy", opentracing.ChildOf(parentCtx))
+	span.SetTag("request_id", requestID)
+	defer span.Finish()
+	defer recoverSpan(span)
+
+	// r.selection and r.rewriter are mutated by doSelection under
+	// selectionInProgress; take the same lock here so tagging the span
+	// doesn't race with a concurrent selection update.
+	r.selectionInProgress.RLock()
+	selection, rewriter := r.selection, r.rewriter
+	r.selectionInProgress.RUnlock()
+
+	if selection != nil {
+		span.SetTag("strategy", r.selector.Strategy.Name())
+		span.SetTag("affinity", strings.Trim(fmt.Sprintf("%v", r.affinityOptions), "[]"))
+	}
+	if rewriter != nil {
+		u := *req.URL
+		rewriter(&u)
+		span.SetTag("backend", backend(&u))
+		logger.Info("proxying request", "backend", backend(&u))
+	}
+	r.tracer.Inject(span, req)
+
 	r.buffer.ServeHTTP(w, retryableRequest(req))
 }
 
-func (r *Router) doSelection() {
+func (r *Router) doSelection(ctx context.Context, reason string) {
 	select {
 	case _ = <-r.theConch:
 		r.selectionInProgress.Lock()
 		defer r.selectionInProgress.Unlock()
-		if log.GetLevel() >= log.DebugLevel {
-			log.Debugf("Got selection lock; performing selection")
+		// Always return the conch, even if a panic below is recovered, so a
+		// failed selection can't permanently wedge future selections in the
+		// default: branch.
+		defer func() { r.theConch <- struct{}{} }()
+		if ctx.Err() != nil {
+			return
+		}
+		selectionID, err := uuid.GenerateUUID()
+		if err != nil {
+			selectionID = "unknown"
 		}
+		logger := r.Logger.With("selection_id", selectionID, "strategy", r.selector.Strategy.Name(), "interval", r.interval)
+		logger.Debug("got selection lock; performing selection", "reason", reason)
+		r.lastSelectionMu.Lock()
+		r.lastSelectionReason = reason
+		r.lastSelectionMu.Unlock()
 
-		result, err := r.selector.Select()
+		span := r.tracer.StartSpan("mpp.select")
+		span.SetTag("selection_id", selectionID)
+		defer span.Finish()
+		// This runs in NewRouter's background loop, which has no enclosing
+		// recover; without this a panic here would crash the process.
+		defer recoverSpanAndContinue(span)
+
+		result, selErr := r.selector.Select()
+		span.SetTag("candidate_count", len(result.Candidates))
+		span.SetTag("selected_count", len(result.Selection))
+		span.LogKV("candidates", fmt.Sprintf("%v", result.Candidates), "selected", fmt.Sprintf("%v", result.Selection))
+		logger = logger.With("candidate_count", len(result.Candidates), "selected_count", len(result.Selection))
 
 		if result.Selection == nil || len(result.Selection) == 0 {
-			if err != nil {
-				log.Errorf("Selector returned no valid selection, and error: %v", err)
+			if selErr != nil {
+				logger.Error("selector returned no valid selection, and error", "error", selErr)
 				if r.selection == nil {
 					r.selection = result
 				}
 			} else {
 				r.selection = result
-				log.Warnf("Selector returned no valid selection")
+				logger.Warn("selector returned no valid selection")
 			}
 		} else {
-			if log.GetLevel() >= log.DebugLevel {
-				log.Debugf("Selected targets: %v", result.Selection)
-			}
+			logger.Debug("selected targets", "targets", result.Selection)
 			if r.selection == nil || !equal(r.selection.Selection, result.Selection) {
-				log.Infof("New targets differ from current selection %v; updating rewriter => %v", r.selection, result)
+				logger.Info("new targets differ from current selection; updating rewriter",
+					"previous", r.selection, "current", result)
 				r.rewriter = func(u *url.URL) {
 					selection := result.Selection
 					i := r.selector.Strategy.NextIndex(selection)
@@ -124,22 +332,17 @@ func (r *Router) doSelection() {
 					u.Host = target.Host
 					u.Scheme = target.Scheme
 				}
-			} else if log.GetLevel() >= log.DebugLevel {
-				log.Debugf("Selection is unchanged: %v", r.selection)
+			} else {
+				logger.Debug("selection is unchanged", "selection", r.selection)
 			}
 			r.selection = result
 		}
 
 		r.metrics.selectedBackends.Set(float64(len(result.Selection)))
 		r.metrics.selectionEvents.Inc()
-		if log.GetLevel() >= log.DebugLevel {
-			log.Debugf("Returning selection lock")
-		}
-		r.theConch <- struct{}{}
+		logger.Debug("returning selection lock")
 	default:
-		if log.GetLevel() >= log.DebugLevel {
-			log.Debugf("Selection is already in-progress; awaiting result")
-		}
+		r.Logger.Debug("selection is already in-progress; awaiting result")
 		r.selectionInProgress.RLock()
 		defer r.selectionInProgress.RUnlock()
 	}
@@ -169,6 +372,9 @@ func backend(u *url.URL) string {
 
 // Status returns a summary of the router's current state
 func (r *Router) Status() *Status {
+	r.lastSelectionMu.RLock()
+	reason := r.lastSelectionReason
+	r.lastSelectionMu.RUnlock()
 	return &Status{
 		Endpoints:           r.selection.Candidates,
 		Strategy:            r.selector.Strategy.Name(),
@@ -176,5 +382,6 @@ func (r *Router) Status() *Status {
 		ComparisonMetric:    r.selector.Strategy.ComparisonMetricName(),
 		AffinityOptions:     strings.Trim(fmt.Sprintf("%v", r.affinityOptions), "[]"),
 		Interval:            r.interval,
+		LastSelectionReason: reason,
 	}
 }
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matt-deboer/mpp/pkg/locator"
+)
+
+// staticLocator implements locator.Locator but not locator.Watcher, modeling
+// a locator that only supports polling.
+type staticLocator struct{}
+
+func (staticLocator) Locate() ([]*locator.PrometheusEndpoint, error) { return nil, nil }
+
+// fakeWatcher implements both locator.Locator and locator.Watcher, pushing
+// whatever events are written to its events channel.
+type fakeWatcher struct {
+	events chan locator.Event
+}
+
+func (fakeWatcher) Locate() ([]*locator.PrometheusEndpoint, error) { return nil, nil }
+
+func (w fakeWatcher) Watch(ctx context.Context) <-chan locator.Event {
+	return w.events
+}
+
+func TestWatchLocatorsFansInEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fw := fakeWatcher{events: make(chan locator.Event, 1)}
+	r := &Router{locators: []locator.Locator{staticLocator{}, fw}}
+
+	out := r.watchLocators(ctx)
+
+	fw.events <- locator.Event{Type: locator.Added, Source: "fake"}
+	select {
+	case ev := <-out:
+		if ev.Source != "fake" {
+			t.Fatalf("expected event from %q, got %q", "fake", ev.Source)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for fanned-in event")
+	}
+}
+
+func TestWatchLocatorsClosesOutWhenNoWatchers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &Router{locators: []locator.Locator{staticLocator{}}}
+	out := r.watchLocators(ctx)
+
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("expected out to be closed with no pending events")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for out to close")
+	}
+}
+
+// newShutdownTestRouter builds a Router with just the fields Shutdown
+// touches, standing in for the goroutine and conch hand-off NewRouter would
+// otherwise set up, without depending on pkg/selector.
+func newShutdownTestRouter(cancel context.CancelFunc) *Router {
+	r := &Router{
+		theConch:  make(chan struct{}, 1),
+		stopped:   make(chan struct{}),
+		cancel:    cancel,
+		transport: &http.Transport{},
+	}
+	r.theConch <- struct{}{}
+	return r
+}
+
+func TestShutdownWaitsForInFlightSelectionThenReturns(t *testing.T) {
+	loopCtx, loopCancel := context.WithCancel(context.Background())
+	r := newShutdownTestRouter(loopCancel)
+
+	// Simulate doSelection holding the conch for an in-flight selection that
+	// only finishes, and hands the conch back as doSelection's deferred
+	// release does, after ctx has been cancelled.
+	<-r.theConch
+	selecting := make(chan struct{})
+	go func() {
+		close(selecting)
+		<-loopCtx.Done()
+		r.theConch <- struct{}{}
+	}()
+	<-selecting
+
+	// Simulate the background loop itself exiting once ctx is cancelled, as
+	// NewRouter's `defer close(r.stopped)` does.
+	go func() {
+		<-loopCtx.Done()
+		close(r.stopped)
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- r.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return once the in-flight selection and loop stopped")
+	}
+}
+
+func TestShutdownReturnsCtxErrWhenLoopNeverStops(t *testing.T) {
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newShutdownTestRouter(cancel)
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShutdown()
+
+	if err := r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/hashicorp/go-hclog"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+)
+
+var tracingLogger = hclog.Default().Named("tracing")
+
+// Tracer abstracts the tracing backend used by Router, so that tracing can be
+// wired in as an optional dependency. A nil Tracer (or the value returned by
+// noopTracer()) disables tracing entirely.
+type Tracer interface {
+	// StartSpan starts a new span for operationName, optionally as a child of
+	// a span extracted from an inbound request via Extract.
+	StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span
+	// Extract pulls a span context out of the headers of an inbound request.
+	// It returns nil if no span context is present or the tracer is a no-op.
+	Extract(req *http.Request) opentracing.SpanContext
+	// Inject writes the given span's context into the headers of an outbound
+	// request so the downstream call can be correlated with this trace.
+	Inject(span opentracing.Span, req *http.Request)
+}
+
+// NewOpenTracingTracer adapts an opentracing.Tracer for use by Router.
+func NewOpenTracingTracer(tracer opentracing.Tracer) Tracer {
+	return &openTracingTracer{tracer: tracer}
+}
+
+// NewZipkinTracer builds a Tracer that reports spans to a Zipkin collector
+// reachable at collectorURL (e.g. "http://zipkin:9411/api/v1/spans").
+func NewZipkinTracer(serviceName, hostPort, collectorURL string) (Tracer, error) {
+	collector, err := zipkin.NewHTTPCollector(collectorURL)
+	if err != nil {
+		return nil, err
+	}
+	recorder := zipkin.NewRecorder(collector, false, hostPort, serviceName)
+	tracer, err := zipkin.NewTracer(recorder, zipkin.ClientServerSameSpan(true))
+	if err != nil {
+		return nil, err
+	}
+	return NewOpenTracingTracer(tracer), nil
+}
+
+type openTracingTracer struct {
+	tracer opentracing.Tracer
+}
+
+func (t *openTracingTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	return t.tracer.StartSpan(operationName, opts...)
+}
+
+func (t *openTracingTracer) Extract(req *http.Request) opentracing.SpanContext {
+	spanCtx, err := t.tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	if err != nil {
+		tracingLogger.Debug("no inbound span context to extract", "error", err)
+		return nil
+	}
+	return spanCtx
+}
+
+func (t *openTracingTracer) Inject(span opentracing.Span, req *http.Request) {
+	if err := t.tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		tracingLogger.Warn("failed to inject span context into outbound request", "error", err)
+	}
+}
+
+// noopTracer returns a Tracer whose spans are never reported anywhere, used
+// as the default when NewRouter is not given one.
+func noopTracer() Tracer {
+	return NewOpenTracingTracer(opentracing.NoopTracer{})
+}
+
+// recoverSpan recovers a panic, records it on span, and re-panics so the
+// caller's other deferred cleanup (including span.Finish) still runs. Use
+// this in request-handling paths where something upstream (net/http) already
+// recovers per-call, such as ServeHTTP.
+func recoverSpan(span opentracing.Span) {
+	if rec := recover(); rec != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "panic", "error", rec)
+		panic(rec)
+	}
+}
+
+// recoverSpanAndContinue recovers a panic, records it on span, and swallows
+// it. Use this in the background selection loop, which has no enclosing
+// recover of its own: letting a panic from r.selector.Select() escape there
+// would crash the whole process.
+func recoverSpanAndContinue(span opentracing.Span) {
+	if rec := recover(); rec != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("event", "panic", "error", rec)
+		tracingLogger.Error("recovered panic in selection loop", "error", rec)
+	}
+}